@@ -0,0 +1,131 @@
+// Copyright 2017 Vallimamod Abdullah <vma@vallimamod.org>.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// JSONLogger returns a middleware that logs HTTP requests to `out` Writer
+// as one JSON object per line, so logs can be shipped straight into
+// ELK/Loki/Splunk without regexing the Apache log format.
+func JSONLogger(out io.Writer, opts ...Option) func(next http.Handler) http.Handler {
+	return CustomLogger(out, BuildJSONLogLine, opts...)
+}
+
+// BuildJSONLogLine is a LogFormatter that writes params to out as a single
+// JSON object.
+func BuildJSONLogLine(out io.Writer, params LogFormatterParams) {
+	req := params.Request
+
+	buf := make([]byte, 0, 256)
+	buf = append(buf, '{')
+	buf = appendJSONString(buf, "time", params.TimeStamp.Format(time.RFC3339))
+	buf = append(buf, ',')
+	buf = appendJSONString(buf, "remote", params.Host)
+	if user := remoteUser(params.URL); user != "" {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, "user", user)
+	}
+	buf = append(buf, ',')
+	buf = appendJSONString(buf, "method", req.Method)
+	buf = append(buf, ',')
+	buf = appendJSONString(buf, "uri", requestURI(req, params.URL))
+	buf = append(buf, ',')
+	buf = appendJSONString(buf, "proto", req.Proto)
+	buf = append(buf, ',')
+	buf = appendJSONInt(buf, "status", int64(params.StatusCode))
+	buf = append(buf, ',')
+	buf = appendJSONInt(buf, "bytes", int64(params.Size))
+	buf = append(buf, ',')
+	buf = appendJSONFloat(buf, "duration_ms", float64(params.Duration.Nanoseconds())/1e6)
+	if referer := req.Referer(); referer != "" {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, "referer", referer)
+	}
+	if ua := req.UserAgent(); ua != "" {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, "user_agent", ua)
+	}
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, "X-Forwarded-For", xff)
+	}
+	if rid := req.Header.Get("X-Request-Id"); rid != "" {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, "X-Request-Id", rid)
+	}
+	if params.Panic != nil {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, "panic", fmt.Sprint(params.Panic))
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, "stack", string(params.Stack))
+	}
+	buf = append(buf, '}', '\n')
+	out.Write(buf)
+}
+
+// appendJSONString appends `"key":"value"` to buf, escaping value per
+// appendJSONQuoted.
+func appendJSONString(buf []byte, key, value string) []byte {
+	buf = appendJSONKey(buf, key)
+	return appendJSONQuoted(buf, value)
+}
+
+// appendJSONInt appends `"key":value` to buf with value rendered as a JSON number.
+func appendJSONInt(buf []byte, key string, value int64) []byte {
+	buf = appendJSONKey(buf, key)
+	return strconv.AppendInt(buf, value, 10)
+}
+
+// appendJSONFloat appends `"key":value` to buf with value rendered as a JSON number.
+func appendJSONFloat(buf []byte, key string, value float64) []byte {
+	buf = appendJSONKey(buf, key)
+	return strconv.AppendFloat(buf, value, 'f', 3, 64)
+}
+
+func appendJSONKey(buf []byte, key string) []byte {
+	buf = append(buf, '"')
+	buf = append(buf, key...)
+	return append(buf, '"', ':')
+}
+
+// appendJSONQuoted appends s to buf as a double-quoted JSON string literal.
+// Unlike appendQuoted it escapes per JSON's rules instead of Go's: only '"',
+// '\\' and control characters need escaping, and non-ASCII runes pass
+// through unchanged since JSON strings are UTF-8. Invalid UTF-8 bytes are
+// written as U+FFFD rather than escaped.
+func appendJSONQuoted(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf = append(buf, `\"`...)
+		case '\\':
+			buf = append(buf, `\\`...)
+		case '\n':
+			buf = append(buf, `\n`...)
+		case '\r':
+			buf = append(buf, `\r`...)
+		case '\t':
+			buf = append(buf, `\t`...)
+		default:
+			if r < 0x20 {
+				buf = append(buf, `\u00`...)
+				buf = append(buf, lowerhex[r>>4], lowerhex[r&0xF])
+				continue
+			}
+			var runeTmp [utf8.UTFMax]byte
+			n := utf8.EncodeRune(runeTmp[:], r)
+			buf = append(buf, runeTmp[:n]...)
+		}
+	}
+	return append(buf, '"')
+}
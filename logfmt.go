@@ -0,0 +1,110 @@
+// Copyright 2017 Vallimamod Abdullah <vma@vallimamod.org>.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LogfmtLogger returns a middleware that logs HTTP requests to `out` Writer
+// as one logfmt record per line (key=value, space separated), so logs can
+// be shipped straight into ELK/Loki/Splunk without regexing the Apache log
+// format.
+func LogfmtLogger(out io.Writer, opts ...Option) func(next http.Handler) http.Handler {
+	return CustomLogger(out, BuildLogfmtLogLine, opts...)
+}
+
+// BuildLogfmtLogLine is a LogFormatter that writes params to out as a single
+// logfmt record.
+func BuildLogfmtLogLine(out io.Writer, params LogFormatterParams) {
+	req := params.Request
+
+	buf := make([]byte, 0, 256)
+	buf = appendLogfmt(buf, "time", params.TimeStamp.Format(time.RFC3339))
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "remote", params.Host)
+	if user := remoteUser(params.URL); user != "" {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "user", user)
+	}
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "method", req.Method)
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "uri", requestURI(req, params.URL))
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "proto", req.Proto)
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "status", strconv.Itoa(params.StatusCode))
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "bytes", strconv.Itoa(params.Size))
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "duration_ms", strconv.FormatFloat(float64(params.Duration.Nanoseconds())/1e6, 'f', 3, 64))
+	if referer := req.Referer(); referer != "" {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "referer", referer)
+	}
+	if ua := req.UserAgent(); ua != "" {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "user_agent", ua)
+	}
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "X-Forwarded-For", xff)
+	}
+	if rid := req.Header.Get("X-Request-Id"); rid != "" {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "X-Request-Id", rid)
+	}
+	if params.Panic != nil {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "panic", fmt.Sprint(params.Panic))
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "stack", string(params.Stack))
+	}
+	buf = append(buf, '\n')
+	out.Write(buf)
+}
+
+// appendLogfmt appends `key=value` to buf, quoting and escaping value when
+// it contains whitespace, an equals sign, a quote or a backslash.
+func appendLogfmt(buf []byte, key, value string) []byte {
+	buf = append(buf, key...)
+	buf = append(buf, '=')
+	if !needsLogfmtQuoting(value) {
+		return append(buf, value...)
+	}
+	buf = append(buf, '"')
+	for _, r := range value {
+		switch r {
+		case '"':
+			buf = append(buf, `\"`...)
+		case '\\':
+			buf = append(buf, `\\`...)
+		case '\n':
+			buf = append(buf, `\n`...)
+		case '\r':
+			buf = append(buf, `\r`...)
+		default:
+			buf = append(buf, string(r)...)
+		}
+	}
+	return append(buf, '"')
+}
+
+func needsLogfmtQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '"' || r == '=' || r == '\\' {
+			return true
+		}
+	}
+	return false
+}
@@ -11,11 +11,12 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 	"unicode/utf8"
 
-	"github.com/pressly/chi/middleware"
+	"github.com/felixge/httpsnoop"
 )
 
 // CombinedLogger and CommonLogger are middlewares that log to stderr all
@@ -25,34 +26,76 @@ import (
 // These loggers are directly ported from gorilla handlers
 // https://github.com/gorilla/handlers
 
-// CombinedLogger returns a middleware that logs HTTP requests to `out` Writer
-// in combined log format
-func CombinedLogger(out io.Writer) func(next http.Handler) http.Handler {
+// LogFormatterParams carries everything a LogFormatter needs to build a log
+// entry for a handled request. URL is a snapshot of Request.URL taken before
+// the request reaches the wrapped handler, since handlers are free to mutate
+// req.URL in place before CustomLogger gets a chance to log it. Host is the
+// resolved client address to log: normally Request.RemoteAddr with the port
+// stripped, or the proxied client IP when WithProxyHeaders is in effect.
+// Panic and Stack are only set when the entry comes from Recovery: Panic is
+// the recovered value and Stack its symbolized stack trace.
+type LogFormatterParams struct {
+	Request    *http.Request
+	URL        url.URL
+	Host       string
+	TimeStamp  time.Time
+	StatusCode int
+	Size       int
+	Duration   time.Duration
+	Panic      interface{}
+	Stack      []byte
+}
+
+// LogFormatter builds a log entry for the request described by params and
+// writes it to out. BuildCommonLogLine and BuildCombinedLogLine are the
+// formatters backing CommonLogger and CombinedLogger; they're exported so
+// other formats (JSON, logfmt, ...) can be layered on CustomLogger without
+// reimplementing the quoting/host/timestamp logic they share.
+type LogFormatter func(out io.Writer, params LogFormatterParams)
+
+// CustomLogger returns a middleware that logs HTTP requests to `out` Writer
+// using the supplied LogFormatter.
+//
+// Response metrics are captured with httpsnoop instead of chi's
+// WrapResponseWriter, since the latter loses byte counts for handlers that
+// Hijack the connection (WebSockets) or bypass Write via ReadFrom sendfile
+// fast paths. httpsnoop dynamically builds a wrapper that only implements
+// the optional interfaces (Hijacker, Flusher, CloseNotifier, Pusher,
+// ReaderFrom) the underlying ResponseWriter itself implements, so downstream
+// middleware that type-asserts on those interfaces keeps working. Bytes that
+// a handler writes directly to a hijacked connection are not counted in Size.
+func CustomLogger(out io.Writer, f LogFormatter, opts ...Option) func(next http.Handler) http.Handler {
+	cfg := newConfig(opts)
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			t1 := time.Now()
-			w2 := middleware.NewWrapResponseWriter(w)
-			next.ServeHTTP(w2, r)
-			t2 := time.Now()
-			writeCombinedLog(out, r, t1, w2.Status(), w2.BytesWritten(), t2.Sub(t1))
+			url := *r.URL
+			host := cfg.resolveHost(r)
+			m := httpsnoop.CaptureMetrics(next, w, r)
+			f(out, LogFormatterParams{
+				Request:    r,
+				URL:        url,
+				Host:       host,
+				TimeStamp:  t1,
+				StatusCode: m.Code,
+				Size:       int(m.Written),
+				Duration:   m.Duration,
+			})
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
+// CombinedLogger returns a middleware that logs HTTP requests to `out` Writer
+// in combined log format
+func CombinedLogger(out io.Writer, opts ...Option) func(next http.Handler) http.Handler {
+	return CustomLogger(out, BuildCombinedLogLine, opts...)
+}
+
 // CommonLogger returns a middleware that logs HTTP requests to `out` Writer
 // in common log format
-func CommonLogger(out io.Writer) func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		fn := func(w http.ResponseWriter, r *http.Request) {
-			t1 := time.Now()
-			w2 := middleware.NewWrapResponseWriter(w)
-			next.ServeHTTP(w2, r)
-			t2 := time.Now()
-			writeCommonLog(out, r, t1, w2.Status(), w2.BytesWritten(), t2.Sub(t1))
-		}
-		return http.HandlerFunc(fn)
-	}
+func CommonLogger(out io.Writer, opts ...Option) func(next http.Handler) http.Handler {
+	return CustomLogger(out, BuildCommonLogLine, opts...)
 }
 
 const lowerhex = "0123456789abcdef"
@@ -127,42 +170,55 @@ func prettyDuration(dur time.Duration) string {
 	return fmt.Sprintf("%.3fms", ms)
 }
 
-// buildCommonLogLine builds a log entry for req in Apache Common Log Format.
-// ts is the timestamp with which the entry should be logged.
-// status and size are used to provide the response HTTP status and size.
-func buildCommonLogLine(req *http.Request, ts time.Time, status int, size int, delay time.Duration) []byte {
-	username := "-"
-	url := *req.URL
-	if url.User != nil {
-		if name := url.User.Username(); name != "" {
-			username = name
-		}
-	}
-
+// remoteHost returns req.RemoteAddr with any port stripped.
+func remoteHost(req *http.Request) string {
 	host, _, err := net.SplitHostPort(req.RemoteAddr)
-
 	if err != nil {
-		host = req.RemoteAddr
+		return req.RemoteAddr
 	}
+	return host
+}
 
-	uri := req.RequestURI
+// remoteUser returns the userinfo carried by u, or "" if none was set.
+func remoteUser(u url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	return u.User.Username()
+}
 
-	// Requests using the CONNECT method over HTTP/2.0 must use
-	// the authority field (aka r.Host) to identify the target.
-	// Refer: https://httpwg.github.io/specs/rfc7540.html#CONNECT
+// requestURI returns the request-target to log for req, snapshotted as u.
+//
+// Requests using the CONNECT method over HTTP/2.0 must use the authority
+// field (aka r.Host) to identify the target.
+// Refer: https://httpwg.github.io/specs/rfc7540.html#CONNECT
+func requestURI(req *http.Request, u url.URL) string {
 	if req.ProtoMajor == 2 && req.Method == "CONNECT" {
-		uri = req.Host
+		return req.Host
 	}
-	if uri == "" {
-		uri = url.RequestURI()
+	if req.RequestURI != "" {
+		return req.RequestURI
+	}
+	return u.RequestURI()
+}
+
+// buildCommonLogLine builds a log entry for params.Request in Apache Common Log Format.
+func buildCommonLogLine(params *LogFormatterParams) []byte {
+	req := params.Request
+	username := remoteUser(params.URL)
+	if username == "" {
+		username = "-"
 	}
 
+	host := params.Host
+	uri := requestURI(req, params.URL)
+
 	buf := make([]byte, 0, 3*(len(host)+len(username)+len(req.Method)+len(uri)+len(req.Proto)+50)/2)
 	buf = append(buf, host...)
 	buf = append(buf, " - "...)
 	buf = append(buf, username...)
 	buf = append(buf, " ["...)
-	buf = append(buf, ts.Format("02/Jan/2006:15:04:05 -0700")...)
+	buf = append(buf, params.TimeStamp.Format("02/Jan/2006:15:04:05 -0700")...)
 	buf = append(buf, `] "`...)
 	buf = append(buf, req.Method...)
 	buf = append(buf, " "...)
@@ -170,32 +226,53 @@ func buildCommonLogLine(req *http.Request, ts time.Time, status int, size int, d
 	buf = append(buf, " "...)
 	buf = append(buf, req.Proto...)
 	buf = append(buf, `" `...)
-	buf = append(buf, strconv.Itoa(status)...)
+	buf = append(buf, strconv.Itoa(params.StatusCode)...)
 	buf = append(buf, " "...)
-	buf = append(buf, strconv.Itoa(size)...)
+	buf = append(buf, strconv.Itoa(params.Size)...)
 	buf = append(buf, " "...)
-	buf = append(buf, prettyDuration(delay)...)
+	buf = append(buf, prettyDuration(params.Duration)...)
 	return buf
 }
 
-// writeCommonLog writes a log entry for req to w in Apache Common Log Format.
-// ts is the timestamp with which the entry should be logged.
-// status, size and delay are used to provide the response HTTP status, size and delay.
-func writeCommonLog(w io.Writer, req *http.Request, ts time.Time, status, size int, delay time.Duration) {
-	buf := buildCommonLogLine(req, ts, status, size, delay)
+// BuildCommonLogLine is a LogFormatter that writes params to out in Apache
+// Common Log Format.
+func BuildCommonLogLine(out io.Writer, params LogFormatterParams) {
+	buf := buildCommonLogLine(&params)
+	buf = appendPanic(buf, params)
 	buf = append(buf, '\n')
-	w.Write(buf)
+	out.Write(buf)
 }
 
-// writeCombinedLog writes a log entry for req to w in Apache Combined Log Format.
-// ts is the timestamp with which the entry should be logged.
-// status, size and delay are used to provide the response HTTP status, size and delay.
-func writeCombinedLog(w io.Writer, req *http.Request, ts time.Time, status, size int, delay time.Duration) {
-	buf := buildCommonLogLine(req, ts, status, size, delay)
+// BuildCombinedLogLine is a LogFormatter that writes params to out in Apache
+// Combined Log Format.
+func BuildCombinedLogLine(out io.Writer, params LogFormatterParams) {
+	buf := buildCommonLogLine(&params)
 	buf = append(buf, ` "`...)
-	buf = appendQuoted(buf, req.Referer())
+	buf = appendQuoted(buf, params.Request.Referer())
 	buf = append(buf, `" "`...)
-	buf = appendQuoted(buf, req.UserAgent())
-	buf = append(buf, '"', '\n')
-	w.Write(buf)
+	buf = appendQuoted(buf, params.Request.UserAgent())
+	buf = append(buf, '"')
+	buf = appendPanic(buf, params)
+	buf = append(buf, '\n')
+	out.Write(buf)
+}
+
+// appendPanic appends the recovered panic value and its stack trace to buf
+// as free-form text, for the Apache-derived formats that have no structured
+// place to put them. JSON/logfmt formatters serialize params.Panic/Stack as
+// proper fields instead. Both are run through appendQuoted so the entry
+// stays on a single physical line despite the stack trace's newlines.
+func appendPanic(buf []byte, params LogFormatterParams) []byte {
+	if params.Panic == nil {
+		return buf
+	}
+	buf = append(buf, ` panic="`...)
+	buf = appendQuoted(buf, fmt.Sprint(params.Panic))
+	buf = append(buf, '"')
+	if len(params.Stack) > 0 {
+		buf = append(buf, ` stack="`...)
+		buf = appendQuoted(buf, string(params.Stack))
+		buf = append(buf, '"')
+	}
+	return buf
 }
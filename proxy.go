@@ -0,0 +1,140 @@
+// Copyright 2017 Vallimamod Abdullah <vma@vallimamod.org>.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Option configures a logger middleware constructor (CommonLogger,
+// CombinedLogger, JSONLogger, LogfmtLogger, CustomLogger).
+type Option func(*config)
+
+type config struct {
+	trustedProxies []*net.IPNet
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithProxyHeaders makes the logger resolve the client IP from the Forwarded
+// (RFC 7239), X-Forwarded-For and X-Real-IP headers instead of always using
+// Request.RemoteAddr. The headers are only trusted when RemoteAddr itself
+// falls within one of trustedCIDRs; otherwise a client could forge its own
+// X-Forwarded-For and spoof the logged IP. Without this option, deployments
+// behind a load balancer or reverse proxy log the proxy's IP for every
+// request.
+//
+// CIDRs that fail to parse are silently ignored, matching how a misconfigured
+// trust list should fail closed rather than panic in request handling.
+func WithProxyHeaders(trustedCIDRs []string) Option {
+	var nets []*net.IPNet
+	for _, cidr := range trustedCIDRs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return func(c *config) {
+		c.trustedProxies = append(c.trustedProxies, nets...)
+	}
+}
+
+// resolveHost returns the client address to log for req: RemoteAddr with
+// the port stripped, or, if RemoteAddr is a trusted proxy, the first
+// untrusted IP found by walking the proxy chain headers right-to-left.
+func (c *config) resolveHost(req *http.Request) string {
+	host := remoteHost(req)
+	if len(c.trustedProxies) == 0 || !c.isTrusted(host) {
+		return host
+	}
+	if ip := c.clientIPFromHeaders(req); ip != "" {
+		return ip
+	}
+	return host
+}
+
+func (c *config) isTrusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIPFromHeaders walks the Forwarded header, falling back to
+// X-Forwarded-For and then X-Real-IP, to find the client IP a chain of
+// trusted proxies has forwarded. Each chain is walked right-to-left (the
+// order proxies append in) and the first entry that isn't itself a trusted
+// proxy is returned, since anything further left could have been forged by
+// the client.
+func (c *config) clientIPFromHeaders(req *http.Request) string {
+	if fwd := req.Header.Get("Forwarded"); fwd != "" {
+		if ip := c.firstUntrusted(parseForwardedFor(fwd)); ip != "" {
+			return ip
+		}
+	}
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		if ip := c.firstUntrusted(strings.Split(xff, ",")); ip != "" {
+			return ip
+		}
+	}
+	if xri := strings.TrimSpace(req.Header.Get("X-Real-IP")); xri != "" {
+		return xri
+	}
+	return ""
+}
+
+func (c *config) firstUntrusted(ips []string) string {
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(ips[i])
+		if ip != "" && !c.isTrusted(ip) {
+			return ip
+		}
+	}
+	return ""
+}
+
+// parseForwardedFor extracts the ordered "for" identifiers from a Forwarded
+// header (RFC 7239), e.g. `for=192.0.2.60;proto=http, for=198.51.100.17`
+// yields ["192.0.2.60", "198.51.100.17"]. Brackets and ports on the "for"
+// value (`for="[2001:db8::1]:1234"`) are stripped down to the bare IP.
+func parseForwardedFor(header string) []string {
+	var fors []string
+	for _, elem := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "for") {
+				continue
+			}
+			fors = append(fors, stripForwardedFor(strings.Trim(strings.TrimSpace(v), `"`)))
+		}
+	}
+	return fors
+}
+
+func stripForwardedFor(v string) string {
+	if strings.HasPrefix(v, "[") {
+		if end := strings.Index(v, "]"); end != -1 {
+			return v[1:end]
+		}
+		return v
+	}
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		return host
+	}
+	return v
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Vallimamod Abdullah <vma@vallimamod.org>.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// Recovery returns a middleware that recovers panics from the handlers
+// below it, writes a 500 if the response hasn't started yet, and logs the
+// panic to `out` Writer in Apache Common Log Format.
+func Recovery(out io.Writer, opts ...Option) func(next http.Handler) http.Handler {
+	return RecoveryWithFormatter(out, BuildCommonLogLine, opts...)
+}
+
+// RecoveryWithFormatter is like Recovery but logs through the supplied
+// LogFormatter instead of the Common Log Format, so the panic can be
+// captured as a structured field (e.g. with JSONLogger's or LogfmtLogger's
+// formatter) rather than free-form text.
+func RecoveryWithFormatter(out io.Writer, f LogFormatter, opts ...Option) func(next http.Handler) http.Handler {
+	cfg := newConfig(opts)
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			t1 := time.Now()
+			url := *r.URL
+
+			// wroteHeader only gates whether we still need to send a 500; the
+			// actual status/byte count logged comes from m below, which
+			// httpsnoop keeps updated as Write/WriteHeader happen, so it's
+			// still accurate even when ServeHTTP panics partway through.
+			wroteHeader := false
+			tracked := httpsnoop.Wrap(w, httpsnoop.Hooks{
+				WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+					return func(code int) {
+						wroteHeader = true
+						next(code)
+					}
+				},
+				Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+					return func(b []byte) (int, error) {
+						wroteHeader = true
+						return next(b)
+					}
+				},
+				ReadFrom: func(next httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+					return func(src io.Reader) (int64, error) {
+						wroteHeader = true
+						return next(src)
+					}
+				},
+			})
+
+			m := httpsnoop.Metrics{Code: http.StatusOK}
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if !wroteHeader {
+					tracked.WriteHeader(http.StatusInternalServerError)
+					m.Code = http.StatusInternalServerError
+				}
+				f(out, LogFormatterParams{
+					Request:    r,
+					URL:        url,
+					Host:       cfg.resolveHost(r),
+					TimeStamp:  t1,
+					StatusCode: m.Code,
+					Size:       int(m.Written),
+					Duration:   time.Since(t1),
+					Panic:      rec,
+					Stack:      debug.Stack(),
+				})
+			}()
+
+			m.CaptureMetrics(tracked, func(ww http.ResponseWriter) {
+				next.ServeHTTP(ww, r)
+			})
+		}
+		return http.HandlerFunc(fn)
+	}
+}